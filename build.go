@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// buildBinaryPath is where the compiled binary lands inside the image, and
+// doubles as its entrypoint.
+const buildBinaryPath = "/app"
+
+// buildBaseImage returns the base image the compiled binary is layered onto.
+// Override via BUILD_BASE_IMAGE for repos that need more than distroless
+// gives them (libc, certs, timezone data, ...).
+func buildBaseImage() string {
+	if v := os.Getenv("BUILD_BASE_IMAGE"); v != "" {
+		return v
+	}
+	return "gcr.io/distroless/static:latest"
+}
+
+func (h *handler) buildCmd(p printer, cc *channelConfig, ctx *cli.Context) error {
+	sha := ctx.Args().First()
+	if sha == "" {
+		return errors.Errorf("usage: !build <sha>")
+	}
+	digest, err := h.buildAndPushImage(context.Background(), p, cc, sha)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p(fmt.Sprintf("pushed %s:%s (digest %s)", cc.DockerImagePrefix, sha, digest))
+	return nil
+}
+
+// buildAndPushImage fetches the repo's tree at sha from GitHub, compiles it
+// with the local go toolchain, and pushes a minimal OCI image (base image +
+// compiled binary, no Docker daemon involved) to cc.DockerImagePrefix:sha.
+// It returns the resulting image digest.
+func (h *handler) buildAndPushImage(ctx context.Context, p printer, cc *channelConfig, sha string) (string, error) {
+	cl, err := h.githubClientFromENV()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	p("fetching source at " + sha)
+	src, err := h.fetchSource(ctx, cl, cc, sha)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(src)
+
+	p("compiling binary")
+	bin := filepath.Join(src, "built-binary")
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", bin, ".")
+	cmd.Dir = src
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH=amd64", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrap(err, string(out))
+	}
+
+	image := cc.DockerImagePrefix + ":" + sha
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	baseRef, err := name.ParseReference(buildBaseImage())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	p("assembling image from " + buildBaseImage())
+	base, err := remote.Image(baseRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", errors.Wrap(err, "pulling base image")
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return binaryLayerReader(bin, buildBinaryPath)
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	img, err := mutate.AppendLayers(base, layer)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Entrypoint = []string{buildBinaryPath}
+	cfg.Config.Cmd = nil
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	p("pushing " + image)
+	if err := remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return "", errors.Wrap(err, "pushing image")
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return digest.String(), nil
+}
+
+// binaryLayerReader streams a single-file tar containing the binary at
+// binPath, to be used as an image layer, without ever writing a tar file to
+// disk.
+func binaryLayerReader(binPath, targetPath string) (io.ReadCloser, error) {
+	f, err := os.Open(binPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		defer f.Close()
+		err := tw.WriteHeader(&tar.Header{
+			Name: strings.TrimPrefix(targetPath, "/"),
+			Mode: 0755,
+			Size: info.Size(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// fetchSource downloads and extracts the repo tree at sha into a temp
+// directory, returning its path.
+func (h *handler) fetchSource(ctx context.Context, cl *github.Client, cc *channelConfig, sha string) (string, error) {
+	archiveURL, _, err := cl.Repositories.GetArchiveLink(ctx, cc.GithubOrg, cc.GithubRepo, github.Tarball, &github.RepositoryContentGetOptions{Ref: sha})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveURL.String(), nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("downloading source: %s", rsp.Status)
+	}
+
+	dir, err := ioutil.TempDir("", "ts-slack-bot-build-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	gz, err := gzip.NewReader(rsp.Body)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", errors.WithStack(err)
+	}
+
+	// GitHub tarballs nest everything under a single "<org>-<repo>-<sha>/"
+	// directory; we want callers to get the module root directly.
+	var root string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", errors.WithStack(err)
+		}
+		if root == "" {
+			root = strings.SplitN(hdr.Name, "/", 2)[0]
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+		if target != dir && !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			os.RemoveAll(dir)
+			return "", errors.Errorf("archive entry %q escapes extraction dir", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				os.RemoveAll(dir)
+				return "", errors.WithStack(err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				os.RemoveAll(dir)
+				return "", errors.WithStack(err)
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				os.RemoveAll(dir)
+				return "", errors.WithStack(err)
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				os.RemoveAll(dir)
+				return "", errors.WithStack(err)
+			}
+			out.Close()
+		}
+	}
+
+	return filepath.Join(dir, root), nil
+}
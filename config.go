@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// channelConfig describes one Slack channel the bot manages: who's allowed
+// to talk to it, which commands they can run, and which deploy target those
+// commands act on. This is what lets a single bot instance front several
+// services/environments instead of one channel per bot.
+type channelConfig struct {
+	Channel           string   `json:"channel"`
+	AllowedCommands   []string `json:"allowed_commands"`
+	AllowedUsers      []string `json:"allowed_users"`
+	K8sNamespace      string   `json:"k8s_namespace"`
+	K8sDeployment     string   `json:"k8s_deployment"`
+	DockerImagePrefix string   `json:"docker_image_prefix"`
+	GithubOrg         string   `json:"github_org"`
+	GithubRepo        string   `json:"github_repo"`
+}
+
+// allowsUser reports whether userID may run commands in this channel. An
+// empty allow-list means everyone in the channel may.
+func (c *channelConfig) allowsUser(userID string) bool {
+	if len(c.AllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range c.AllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsCommand reports whether cmd may be run in this channel. An empty
+// allow-list means every command the bot knows about is allowed.
+func (c *channelConfig) allowsCommand(cmd string) bool {
+	if len(c.AllowedCommands) == 0 {
+		return true
+	}
+	for _, a := range c.AllowedCommands {
+		if a == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// botConfig is the top-level shape of the file pointed to by CONFIG_FILE.
+type botConfig struct {
+	SlackToken  string          `json:"slack_token"`
+	GithubToken string          `json:"github_token"`
+	Channels    []channelConfig `json:"channels"`
+}
+
+// loadConfig reads and parses path as YAML or JSON (YAML is a superset, so
+// one parser handles both), expanding ${VAR}/$VAR references against the
+// process environment first so secrets don't need to be written to disk in
+// the clear.
+func loadConfig(path string) (*botConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	expanded := os.Expand(string(raw), func(name string) string {
+		return os.Getenv(name)
+	})
+
+	var cfg botConfig
+	if err := yaml.Unmarshal([]byte(expanded), &cfg); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	if cfg.SlackToken == "" {
+		return nil, errors.Errorf("%s: slack_token is required", path)
+	}
+	for _, c := range cfg.Channels {
+		if c.Channel == "" {
+			return nil, errors.Errorf("%s: channel entry missing \"channel\" id", path)
+		}
+	}
+	return &cfg, nil
+}
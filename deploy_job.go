@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+const maxDeployLogBytes = 64 * 1024
+
+// deployProgressInterval is how often the in-flight deploy message is
+// refreshed with the latest rollout status. Configurable since it's a
+// straight tradeoff between Slack API traffic and how stale the message
+// looks.
+func deployProgressInterval() time.Duration {
+	if v := os.Getenv("DEPLOY_PROGRESS_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return 5 * time.Second
+}
+
+// cappedLog accumulates rollout status lines up to maxDeployLogBytes, after
+// which it stops growing and appends a truncation marker once. This keeps a
+// long-running, flappy rollout from producing a Slack message too large to
+// update.
+type cappedLog struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *cappedLog) Printf(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.truncated {
+		return
+	}
+	if c.buf.Len()+len(line)+1 > maxDeployLogBytes {
+		if room := maxDeployLogBytes - c.buf.Len(); room > 0 {
+			c.buf.WriteString(line[:room])
+		}
+		c.buf.WriteString("\n... log truncated ...\n")
+		c.truncated = true
+		return
+	}
+	c.buf.WriteString(line)
+	c.buf.WriteString("\n")
+}
+
+func (c *cappedLog) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// deployJob tracks one in-flight `!deploy` invocation so it can be looked up
+// and cancelled via `!cancel <job-id>`.
+type deployJob struct {
+	id     string
+	cancel context.CancelFunc
+	log    *cappedLog
+}
+
+// jobKey scopes a job id to the channel that started it, so two channels
+// deploying the same sha at once don't clobber each other's entry in
+// h.jobs, and a channel can't cancel another channel's job just by guessing
+// its sha.
+func jobKey(channel, id string) string {
+	return channel + "/" + id
+}
+
+func (h *handler) startDeployJob(channel, id string) (*deployJob, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &deployJob{id: id, cancel: cancel, log: &cappedLog{}}
+
+	h.jobsMu.Lock()
+	if h.jobs == nil {
+		h.jobs = map[string]*deployJob{}
+	}
+	h.jobs[jobKey(channel, id)] = job
+	h.jobsMu.Unlock()
+
+	return job, ctx
+}
+
+func (h *handler) finishDeployJob(channel, id string) {
+	h.jobsMu.Lock()
+	delete(h.jobs, jobKey(channel, id))
+	h.jobsMu.Unlock()
+}
+
+func (h *handler) cancelDeployJob(channel, id string) error {
+	h.jobsMu.Lock()
+	job, ok := h.jobs[jobKey(channel, id)]
+	h.jobsMu.Unlock()
+	if !ok {
+		return errors.Errorf("no in-flight deploy with job id %q", id)
+	}
+	job.cancel()
+	return nil
+}
+
+// watchMessage refreshes ts every interval with the job's accumulated log
+// until ctx is done, swallowing transient Slack API errors so a single
+// hiccup doesn't take down the deploy.
+func watchMessage(ctx context.Context, n *notifier, ts string, job *deployJob, fields []slack.AttachmentField) {
+	ticker := time.NewTicker(deployProgressInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = n.Update(ts, message{Text: job.log.String(), Color: colorInProgress, Fields: fields})
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// k8s lazily builds and caches the typed Kubernetes client used by podsCmd
+// and deployCmd, so the bot doesn't need the kubectl binary in its image.
+func (h *handler) k8s() (kubernetes.Interface, error) {
+	h.k8sOnce.Do(func() {
+		h.k8sClient, h.k8sErr = newK8sClientset()
+	})
+	return h.k8sClient, h.k8sErr
+}
+
+// newK8sClientset uses in-cluster credentials when the service account token
+// is present, falling back to KUBECONFIG/~/.kube/config for local use.
+func newK8sClientset() (kubernetes.Interface, error) {
+	cfg, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cl, nil
+}
+
+func restConfig() (*rest.Config, error) {
+	if _, err := os.Stat(inClusterTokenFile); err == nil {
+		cfg, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return cfg, nil
+	}
+
+	path := os.Getenv("KUBECONFIG")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// k8sRESTConfig is the minimal set of fields we need to talk to the apiserver.
+type k8sRESTConfig struct {
+	Host        string
+	BearerToken string
+	CAFile      string
+	Insecure    bool
+}
+
+// loadK8sRESTConfig resolves in-cluster credentials first, falling back to
+// the kubeconfig pointed at by KUBECONFIG (or ~/.kube/config) when the
+// service account token isn't present, e.g. when running the bot locally.
+func loadK8sRESTConfig() (*k8sRESTConfig, error) {
+	if _, err := os.Stat(inClusterTokenFile); err == nil {
+		return loadInClusterK8sConfig()
+	}
+	return loadKubeconfigK8sConfig()
+}
+
+func loadInClusterK8sConfig() (*k8sRESTConfig, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_PORT_443_TCP_PORT")
+	if host == "" || port == "" {
+		return nil, errors.Errorf("in-cluster token found but KUBERNETES_SERVICE_HOST/KUBERNETES_PORT_443_TCP_PORT are not set")
+	}
+	token, err := ioutil.ReadFile(inClusterTokenFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &k8sRESTConfig{
+		Host:        "https://" + host + ":" + port,
+		BearerToken: strings.TrimSpace(string(token)),
+		CAFile:      inClusterCAFile,
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                string `json:"server"`
+			CertificateAuthority  string `json:"certificate-authority"`
+			InsecureSkipTLSVerify bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token string `json:"token"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+func loadKubeconfigK8sConfig() (*k8sRESTConfig, error) {
+	path := os.Getenv("KUBECONFIG")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(b, &kc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			break
+		}
+	}
+	if clusterName == "" {
+		return nil, errors.Errorf("no context named %q in %s", kc.CurrentContext, path)
+	}
+
+	cfg := &k8sRESTConfig{}
+	for _, c := range kc.Clusters {
+		if c.Name == clusterName {
+			cfg.Host = c.Cluster.Server
+			cfg.CAFile = c.Cluster.CertificateAuthority
+			cfg.Insecure = c.Cluster.InsecureSkipTLSVerify
+			break
+		}
+	}
+	for _, u := range kc.Users {
+		if u.Name == userName {
+			cfg.BearerToken = u.User.Token
+			break
+		}
+	}
+	if cfg.Host == "" {
+		return nil, errors.Errorf("no cluster named %q in %s", clusterName, path)
+	}
+	return cfg, nil
+}
+
+func tlsConfigFor(caFile string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		if insecure {
+			return tlsConfig, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+func (c *k8sRESTConfig) client() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CAFile != "" || c.Insecure {
+		tlsConfig, err := tlsConfigFor(c.CAFile, c.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// k8sEvent mirrors the subset of api/v1.Event we render into Slack.
+type k8sEvent struct {
+	Type           string `json:"type"`
+	Reason         string `json:"reason"`
+	Message        string `json:"message"`
+	Count          int    `json:"count"`
+	InvolvedObject struct {
+		Kind      string `json:"kind"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"involvedObject"`
+}
+
+type k8sWatchEvent struct {
+	Type   string   `json:"type"`
+	Object k8sEvent `json:"object"`
+}
+
+// watchK8sEvents runs until the process exits, tailing the apiserver's event
+// watch endpoint and forwarding noteworthy events to the channels whose
+// K8sNamespace matches the event. It's meant to be started alongside
+// handler.run as a second, independent subsystem.
+func (h *handler) watchK8sEvents(l *log.Logger, cl *slack.Client) {
+	if len(h.channelConfigsSnapshot()) == 0 {
+		l.Printf("k8s events: disabled: no channels configured")
+		return
+	}
+	cfg, err := loadK8sRESTConfig()
+	if err != nil {
+		l.Printf("k8s events: disabled: %v", err)
+		return
+	}
+	httpClient, err := cfg.client()
+	if err != nil {
+		l.Printf("k8s events: disabled: %v", err)
+		return
+	}
+
+	var reasonFilter *regexp.Regexp
+	if h.K8sEventReasonFilter != "" {
+		reasonFilter, err = regexp.Compile(h.K8sEventReasonFilter)
+		if err != nil {
+			l.Printf("k8s events: invalid K8S_EVENT_REASON_FILTER: %v", err)
+			return
+		}
+	}
+
+	dedup := newEventDedup(h.K8sEventDedupInterval)
+
+	for {
+		if err := h.watchK8sEventsOnce(l, httpClient, cfg, cl, dedup, reasonFilter); err != nil {
+			l.Printf("k8s events: watch ended: %v, reconnecting in 5s", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (h *handler) watchK8sEventsOnce(l *log.Logger, httpClient *http.Client, cfg *k8sRESTConfig, cl *slack.Client, dedup *eventDedup, reasonFilter *regexp.Regexp) error {
+	// Re-snapshot on every (re)connect so a config reload via SIGHUP
+	// (handler.watchConfigReloadSignal) is picked up without restarting the
+	// bot: a channel added after a reload starts getting events, and one
+	// removed stops.
+	channels := h.channelConfigsSnapshot()
+	path := "/api/v1/events"
+	if h.K8sEventNamespace != "" {
+		path = "/api/v1/namespaces/" + h.K8sEventNamespace + "/events"
+	}
+	req, err := http.NewRequest("GET", cfg.Host+path+"?watch=true", nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	}
+
+	rsp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("watch request failed: %s", rsp.Status)
+	}
+
+	scanner := bufio.NewScanner(rsp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var we k8sWatchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &we); err != nil {
+			l.Printf("k8s events: skipping unparseable line: %v", err)
+			continue
+		}
+		ev := we.Object
+		if h.K8sEventMinLevel == "Warning" && ev.Type != "Warning" {
+			continue
+		}
+		if reasonFilter != nil && !reasonFilter.MatchString(ev.Reason) {
+			continue
+		}
+		if !dedup.allow(ev.InvolvedObject.Namespace, ev.InvolvedObject.Name, ev.Reason) {
+			continue
+		}
+		for _, ch := range channels {
+			// Only forward an event to channels watching the namespace it
+			// happened in, so e.g. a "prod" channel never sees "staging"
+			// events just because both are configured on this bot.
+			if ch.K8sNamespace == "" || ch.K8sNamespace != ev.InvolvedObject.Namespace {
+				continue
+			}
+			if err := postK8sEventAttachment(cl, ch.Channel, ev); err != nil {
+				l.Printf("k8s events: failed to post to slack: %v", err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func postK8sEventAttachment(cl *slack.Client, channelID string, ev k8sEvent) error {
+	color := "good"
+	switch {
+	case ev.Type != "Normal" && ev.Count > 1:
+		color = "danger"
+	case ev.Type != "Normal":
+		color = "warning"
+	}
+
+	attachment := slack.Attachment{
+		Color:    color,
+		Title:    fmt.Sprintf("%s: %s/%s", ev.Reason, ev.InvolvedObject.Kind, ev.InvolvedObject.Name),
+		Text:     ev.Message,
+		Fallback: fmt.Sprintf("%s %s/%s: %s", ev.Reason, ev.InvolvedObject.Kind, ev.InvolvedObject.Name, ev.Message),
+		Fields: []slack.AttachmentField{
+			{Title: "Kind", Value: ev.InvolvedObject.Kind, Short: true},
+			{Title: "Name", Value: ev.InvolvedObject.Name, Short: true},
+			{Title: "Reason", Value: ev.Reason, Short: true},
+			{Title: "Count", Value: fmt.Sprintf("%d", ev.Count), Short: true},
+		},
+	}
+	_, _, err := cl.PostMessage(channelID, slack.MsgOptionAttachments(attachment))
+	return errors.WithStack(err)
+}
+
+// eventDedup suppresses repeat notifications for the same (namespace, name,
+// reason) within a configurable interval, since the apiserver will otherwise
+// keep re-sending an Event object every time its Count is bumped.
+type eventDedup struct {
+	interval time.Duration
+	mu       sync.Mutex
+	seen     map[string]time.Time
+}
+
+func newEventDedup(interval time.Duration) *eventDedup {
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	return &eventDedup{interval: interval, seen: map[string]time.Time{}}
+}
+
+func (d *eventDedup) allow(namespace, name, reason string) bool {
+	key := namespace + "/" + name + "/" + reason
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if last, ok := d.seen[key]; ok && now.Sub(last) < d.interval {
+		return false
+	}
+	d.seen[key] = now
+	return true
+}
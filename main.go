@@ -3,11 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/google/go-github/github"
 	shellwords "github.com/mattn/go-shellwords"
@@ -15,6 +20,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/oauth2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 )
 
 func main() {
@@ -29,26 +37,60 @@ func main() {
 }
 
 type handler struct {
-	SlackToken        string
-	GithubToken       string
-	GithubOrg         string
-	GithubRepo        string
-	DockerImagePrefix string
-	K8sNamespace      string
-	K8sDeployment     string
+	SlackToken  string
+	GithubToken string
+
+	configPath string
+	cfgMu      sync.RWMutex
+	channels   []channelConfig
+
+	K8sEventNamespace     string
+	K8sEventMinLevel      string
+	K8sEventReasonFilter  string
+	K8sEventDedupInterval time.Duration
+
+	k8sOnce   sync.Once
+	k8sClient kubernetes.Interface
+	k8sErr    error
+
+	lastSHAMu sync.Mutex
+	lastSHA   map[string]string
+
+	jobsMu sync.Mutex
+	jobs   map[string]*deployJob
 }
 
 func newHandler() (*handler, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil, errors.Errorf("CONFIG_FILE must be set")
+	}
+
 	h := &handler{
-		SlackToken:        os.Getenv("SLACK_TOKEN"),
-		GithubToken:       os.Getenv("GITHUB_TOKEN"),
-		GithubOrg:         os.Getenv("GITHUB_ORG"),
-		GithubRepo:        os.Getenv("GITHUB_REPO"),
-		DockerImagePrefix: os.Getenv("DOCKER_IMAGE_PREFIX"),
-		K8sNamespace:      os.Getenv("K8S_NAMESPACE"),
-		K8sDeployment:     os.Getenv("K8S_DEPLOYMENT"),
-	}
-	// TODO: validate all variables are set
+		configPath: path,
+		lastSHA:    map[string]string{},
+
+		K8sEventNamespace:     os.Getenv("K8S_EVENT_NAMESPACE"),
+		K8sEventMinLevel:      os.Getenv("K8S_EVENT_MIN_LEVEL"),
+		K8sEventReasonFilter:  os.Getenv("K8S_EVENT_REASON_FILTER"),
+		K8sEventDedupInterval: 5 * time.Minute,
+	}
+	if v := os.Getenv("K8S_EVENT_DEDUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid K8S_EVENT_DEDUP_INTERVAL")
+		}
+		h.K8sEventDedupInterval = d
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	h.SlackToken = cfg.SlackToken
+	h.GithubToken = cfg.GithubToken
+	h.channels = cfg.Channels
+
 	return h, nil
 }
 
@@ -64,39 +106,17 @@ func (h *handler) run(l *log.Logger) error {
 	}
 	l.Printf(rsp.UserID)
 
-	list, err := cl.GetChannels(true)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	chans := []string{}
-	for _, c := range list {
-		ok := func() bool {
-			for _, m := range c.Members {
-				if m == rsp.UserID {
-					return true
-				}
-			}
-			return false
-		}()
-		if ok {
-			chans = append(chans, c.ID)
-		}
-	}
-
-	if len(chans) != 1 {
-		return errors.Errorf("must only be in one channel")
-	}
-	channelID := chans[0]
-
-	l.Printf("channel=%s", channelID)
+	go h.watchK8sEvents(l, cl)
+	go h.watchConfigReloadSignal(l)
 
 	for c := range rtm.IncomingEvents {
 		l.Printf("%s %T", c.Type, c.Data)
 		switch cc := c.Data.(type) {
 		case *slack.HelloEvent:
-			msg := rtm.NewOutgoingMessage("Hi there", channelID)
-			rtm.SendMessage(msg)
 			_ = cc
+			for _, id := range h.channelIDs() {
+				rtm.SendMessage(rtm.NewOutgoingMessage("Hi there", id))
+			}
 		case *slack.MessageEvent:
 			if cc.User == rsp.UserID {
 				continue
@@ -109,16 +129,46 @@ func (h *handler) run(l *log.Logger) error {
 				msg := rtm.NewOutgoingMessage(s, cc.Channel)
 				rtm.SendMessage(msg)
 			})
+
+			chCfg, ok := h.channelConfigFor(cc.Channel)
+			if !ok {
+				l.Printf("ignoring message from unconfigured channel %s", cc.Channel)
+				continue
+			}
+			if !chCfg.allowsUser(cc.User) {
+				printer("sorry, you're not allowed to run commands in this channel")
+				continue
+			}
+
 			buf := &bytes.Buffer{}
 			app := &cli.App{Name: "GDG Bot"}
-			app.Commands = []cli.Command{
-				{Name: "pods", Action: adapt(printer, podsCmd), Flags: []cli.Flag{
-					cli.StringFlag{Name: "namespace"},
-				}},
+			n, err := newNotifier(cl, cc.Channel)
+			if err != nil {
+				printer("error: " + err.Error())
+				continue
+			}
+
+			all := []cli.Command{
+				{Name: "pods", Action: adaptChan(printer, chCfg, h.podsCmd)},
+				{
+					Name: "deploy", Action: adaptDeploy(printer, n, chCfg, h.deployCmd),
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "build"},
+					},
+				},
+				{
+					Name: "build", Action: adaptChan(printer, chCfg, h.buildCmd),
+				},
 				{
-					Name: "deploy", Action: adapt(printer, h.deployCmd),
+					Name: "cancel", Action: adaptChan(printer, chCfg, h.cancelCmd),
 				},
 			}
+			for _, cmd := range all {
+				if chCfg.allowsCommand(cmd.Name) {
+					app.Commands = append(app.Commands, cmd)
+				}
+			}
+
 			app.ExitErrHandler = func(*cli.Context, error) {}
 			app.Writer = buf
 			app.ErrWriter = buf
@@ -127,32 +177,103 @@ func (h *handler) run(l *log.Logger) error {
 				printer("error: " + err.Error())
 				continue
 			}
-			app.Run(append([]string{"foo"}, args...))
 
-			if buf.Len() > 0 {
-				printer("```" + buf.String() + "```")
-			}
+			// Run the command on its own goroutine: deploy blocks for the
+			// full rollout, and the RTM loop needs to stay free to read the
+			// next message (e.g. !cancel) while that's in flight.
+			go func() {
+				app.Run(append([]string{"foo"}, args...))
+				if buf.Len() > 0 {
+					printer("```" + buf.String() + "```")
+				}
+			}()
 		}
 	}
 	return nil
 }
 
+// channelIDs returns the channel IDs this bot instance is configured to
+// operate in, for things (like the greeting sent on connect) that aren't
+// tied to a single incoming command.
+func (h *handler) channelIDs() []string {
+	h.cfgMu.RLock()
+	defer h.cfgMu.RUnlock()
+	ids := make([]string, len(h.channels))
+	for i, c := range h.channels {
+		ids[i] = c.Channel
+	}
+	return ids
+}
+
+// channelConfigsSnapshot returns a copy of the configured channels, for
+// subsystems (like the k8s event forwarder) that need to scope their own
+// behavior per channel but shouldn't hold onto h.channels across a reload.
+func (h *handler) channelConfigsSnapshot() []channelConfig {
+	h.cfgMu.RLock()
+	defer h.cfgMu.RUnlock()
+	channels := make([]channelConfig, len(h.channels))
+	copy(channels, h.channels)
+	return channels
+}
+
+// channelConfigFor returns the config entry for channelID, if any. The
+// returned pointer is a copy, safe to use after the config is reloaded out
+// from under it.
+func (h *handler) channelConfigFor(channelID string) (*channelConfig, bool) {
+	h.cfgMu.RLock()
+	defer h.cfgMu.RUnlock()
+	for _, c := range h.channels {
+		if c.Channel == channelID {
+			cc := c
+			return &cc, true
+		}
+	}
+	return nil, false
+}
+
+// watchConfigReloadSignal reloads the channel list from CONFIG_FILE whenever
+// the process receives SIGHUP, so channels/permissions can be changed
+// without a restart.
+func (h *handler) watchConfigReloadSignal(l *log.Logger) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		cfg, err := loadConfig(h.configPath)
+		if err != nil {
+			l.Printf("config reload failed: %v", err)
+			continue
+		}
+		h.cfgMu.Lock()
+		h.channels = cfg.Channels
+		h.cfgMu.Unlock()
+		l.Printf("config reloaded: %d channel(s)", len(cfg.Channels))
+	}
+}
+
 type printer func(string)
 
-func adapt(p printer, f func(printer, *cli.Context) error) func(*cli.Context) error {
+func adaptChan(p printer, cc *channelConfig, f func(printer, *channelConfig, *cli.Context) error) func(*cli.Context) error {
+	return func(ctx *cli.Context) error {
+		return f(p, cc, ctx)
+	}
+}
+
+func adaptDeploy(p printer, n *notifier, cc *channelConfig, f func(printer, *notifier, *channelConfig, *cli.Context) error) func(*cli.Context) error {
 	return func(ctx *cli.Context) error {
-		return f(p, ctx)
+		return f(p, n, cc, ctx)
 	}
 }
 
-func (h *handler) deployCmd(p printer, ctx *cli.Context) error {
-	p("about to deploy")
+func (h *handler) deployCmd(p printer, n *notifier, cc *channelConfig, ctx *cli.Context) error {
+	if ctx.Bool("build") && !cc.allowsCommand("build") {
+		return errors.Errorf("the build flag is not allowed in this channel")
+	}
 
 	cl, err := h.githubClientFromENV()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	list, _, err := cl.Repositories.ListCommits(context.Background(), h.GithubOrg, h.GithubRepo, nil)
+	list, _, err := cl.Repositories.ListCommits(context.Background(), cc.GithubOrg, cc.GithubRepo, nil)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -169,42 +290,211 @@ func (h *handler) deployCmd(p printer, ctx *cli.Context) error {
 	if sha == "" {
 		return errors.Errorf("no sha found")
 	}
-	p(fmt.Sprintf("%d commits", len(list)))
-	image := h.DockerImagePrefix + ":" + sha
-	p("deploying image " + image)
-	b, err := exec.Command("kubectl", "-n", h.K8sNamespace, "set", "image", "deployments/"+h.K8sDeployment, "*="+image).CombinedOutput()
+	image := cc.DockerImagePrefix + ":" + sha
+
+	digest := ""
+	if ctx.Bool("build") {
+		p("building " + image + " before deploying")
+		digest, err = h.buildAndPushImage(context.Background(), p, cc, sha)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	fields := h.deployFields(cc, sha, image)
+	if digest != "" {
+		fields = append(fields, slack.AttachmentField{Title: "Digest", Value: digest, Short: false})
+	}
+
+	ts, err := n.Post(message{
+		Text:   "deploying " + image,
+		Color:  colorInProgress,
+		Fields: fields,
+	})
 	if err != nil {
-		p("ERROR: " + string(b))
-		return nil
+		return errors.WithStack(err)
+	}
+
+	job, jobCtx := h.startDeployJob(cc.Channel, sha)
+	defer h.finishDeployJob(cc.Channel, sha)
+	defer job.cancel()
+	p(fmt.Sprintf("job id: %s (cancel with `!cancel %s`)", sha, sha))
+
+	k, err := h.k8s()
+	if err != nil {
+		return n.Update(ts, message{Text: "ERROR: " + err.Error(), Color: colorFailure, Fields: fields})
+	}
+
+	previousImage, err := h.setDeploymentImage(k, cc.K8sNamespace, cc.K8sDeployment, image)
+	if err != nil {
+		return n.Update(ts, message{Text: "ERROR: " + err.Error(), Color: colorFailure, Fields: fields})
+	}
+
+	go watchMessage(jobCtx, n, ts, job, fields)
+
+	err = h.watchRollout(jobCtx, job.log.Printf, k, cc.K8sNamespace, cc.K8sDeployment)
+	if errors.Cause(err) == context.Canceled {
+		job.log.Printf("deploy cancelled, rolling back to " + previousImage)
+		if _, rbErr := h.setDeploymentImage(k, cc.K8sNamespace, cc.K8sDeployment, previousImage); rbErr != nil {
+			job.log.Printf("rollback failed: " + rbErr.Error())
+		} else if rbErr := h.watchRollout(context.Background(), job.log.Printf, k, cc.K8sNamespace, cc.K8sDeployment); rbErr != nil {
+			job.log.Printf("rollback did not complete cleanly: " + rbErr.Error())
+		}
+		return n.Update(ts, message{Text: job.log.String(), Color: colorFailure, Fields: fields})
 	}
-	p(string(b))
-	b, err = exec.Command("kubectl", "-n", h.K8sNamespace, "rollout", "status", "deployments/"+h.K8sDeployment).CombinedOutput()
 	if err != nil {
-		p("ERROR: " + string(b))
+		return n.Update(ts, message{Text: job.log.String() + "\nERROR: " + err.Error(), Color: colorFailure, Fields: fields})
+	}
+
+	h.lastSHAMu.Lock()
+	h.lastSHA[cc.Channel] = sha
+	h.lastSHAMu.Unlock()
+
+	return n.Update(ts, message{Text: job.log.String() + "\nfinished deployment", Color: colorSuccess, Fields: fields})
+}
+
+func (h *handler) cancelCmd(p printer, cc *channelConfig, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.Errorf("usage: !cancel <job-id>")
+	}
+	if err := h.cancelDeployJob(cc.Channel, id); err != nil {
+		p(err.Error())
 		return nil
 	}
-	p(string(b))
-	p("finished deployment")
+	p("cancelling job " + id)
 	return nil
 }
 
+// deployFields builds the attachment fields shown on a deploy message: the
+// commit, the image, where it's going, and a compare link against whatever
+// was last deployed to this channel (in this process's lifetime).
+func (h *handler) deployFields(cc *channelConfig, sha, image string) []slack.AttachmentField {
+	compareURL := fmt.Sprintf("https://github.com/%s/%s/commit/%s", cc.GithubOrg, cc.GithubRepo, sha)
+	h.lastSHAMu.Lock()
+	last := h.lastSHA[cc.Channel]
+	h.lastSHAMu.Unlock()
+	if last != "" && last != sha {
+		compareURL = fmt.Sprintf("https://github.com/%s/%s/compare/%s...%s", cc.GithubOrg, cc.GithubRepo, last, sha)
+	}
+
+	return []slack.AttachmentField{
+		{Title: "Commit", Value: sha, Short: true},
+		{Title: "Image", Value: image, Short: true},
+		{Title: "Namespace", Value: cc.K8sNamespace, Short: true},
+		{Title: "Deployment", Value: cc.K8sDeployment, Short: true},
+		{Title: "Compare", Value: compareURL, Short: false},
+	}
+}
+
+// setDeploymentImage patches every container image in the Deployment's pod
+// spec to image, mirroring `kubectl set image deployments/x *=image`. It
+// returns the image that was previously set, so a cancelled deploy can roll
+// back to it.
+func (h *handler) setDeploymentImage(k kubernetes.Interface, namespace, deployment, image string) (previousImage string, err error) {
+	deployments := k.AppsV1().Deployments(namespace)
+	dep, err := deployments.Get(context.Background(), deployment, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(dep.Spec.Template.Spec.Containers) > 0 {
+		previousImage = dep.Spec.Template.Spec.Containers[0].Image
+	}
+	for i := range dep.Spec.Template.Spec.Containers {
+		dep.Spec.Template.Spec.Containers[i].Image = image
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": dep.Spec.Template.Spec.Containers,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if _, err := deployments.Patch(context.Background(), deployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return previousImage, nil
+}
+
+// watchRollout polls the Deployment's status the way `kubectl rollout
+// status` does, reporting progress to p until it's fully rolled out or ctx
+// is cancelled.
+func (h *handler) watchRollout(ctx context.Context, p func(string), k kubernetes.Interface, namespace, deployment string) error {
+	deployments := k.AppsV1().Deployments(namespace)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		dep, err := deployments.Get(ctx, deployment, metav1.GetOptions{})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		want := int32(1)
+		if dep.Spec.Replicas != nil {
+			want = *dep.Spec.Replicas
+		}
+		status := dep.Status
+
+		if dep.Generation <= status.ObservedGeneration &&
+			status.UpdatedReplicas >= want &&
+			status.Replicas == status.UpdatedReplicas &&
+			status.AvailableReplicas >= want {
+			p(fmt.Sprintf("rollout complete: %d/%d replicas available", status.AvailableReplicas, want))
+			return nil
+		}
+
+		p(fmt.Sprintf("waiting for rollout: %d/%d updated, %d/%d available", status.UpdatedReplicas, want, status.AvailableReplicas, want))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
 func (h *handler) githubClientFromENV() (*github.Client, error) {
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: h.GithubToken})
 	tc := oauth2.NewClient(oauth2.NoContext, ts)
 	return github.NewClient(tc), nil
 }
 
-func podsCmd(p printer, ctx *cli.Context) error {
+func (h *handler) podsCmd(p printer, cc *channelConfig, ctx *cli.Context) error {
 	p("about to list pods")
-	args := []string{"get", "pods"}
-	if n := ctx.String("namespace"); n != "" {
-		args = append(args, "-n", n)
+
+	k, err := h.k8s()
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	b, err := exec.Command("kubectl", args...).CombinedOutput()
+
+	list, err := k.CoreV1().Pods(cc.K8sNamespace).List(context.Background(), metav1.ListOptions{})
 	if err != nil {
-		log.Printf("err=%q", string(b))
-	} else {
-		p("```" + string(b) + "```")
+		log.Printf("err=%q", err)
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tREADY\tSTATUS\tRESTARTS")
+	for _, pod := range list.Items {
+		ready := 0
+		restarts := int32(0)
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Ready {
+				ready++
+			}
+			restarts += cs.RestartCount
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%d\n", pod.Name, ready, len(pod.Status.ContainerStatuses), pod.Status.Phase, restarts)
 	}
+	tw.Flush()
+	p("```" + buf.String() + "```")
 	return nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+// Attachment colors used for the deploy status message as it progresses.
+const (
+	colorInProgress = "warning"
+	colorSuccess    = "good"
+	colorFailure    = "danger"
+)
+
+// message is the structured content behind a single Slack attachment. It's a
+// small step up from a plain string so deployCmd can show color-coded status
+// and fields instead of a wall of RTM text.
+type message struct {
+	Text   string
+	Color  string
+	Fields []slack.AttachmentField
+}
+
+func (m message) attachment() slack.Attachment {
+	return slack.Attachment{
+		Text:     m.Text,
+		Color:    m.Color,
+		Fields:   m.Fields,
+		Fallback: m.Text,
+	}
+}
+
+// notifier posts and updates a single Slack message via the web API (as
+// opposed to the plain-text RTM path), so a long-running command like
+// deploy can keep one attachment up to date instead of spamming the channel.
+//
+// If SLACK_CUSTOM_PAYLOAD is set, its fields are merged into every
+// attachment this notifier sends, letting admins add extra attachment
+// fields without a code change.
+type notifier struct {
+	cl            *slack.Client
+	channelID     string
+	customPayload *slack.Attachment
+}
+
+func newNotifier(cl *slack.Client, channelID string) (*notifier, error) {
+	n := &notifier{cl: cl, channelID: channelID}
+	if raw := os.Getenv("SLACK_CUSTOM_PAYLOAD"); raw != "" {
+		var a slack.Attachment
+		if err := json.Unmarshal([]byte(raw), &a); err != nil {
+			return nil, errors.Wrap(err, "invalid SLACK_CUSTOM_PAYLOAD")
+		}
+		n.customPayload = &a
+	}
+	return n, nil
+}
+
+func (n *notifier) merge(m message) slack.Attachment {
+	a := m.attachment()
+	if n.customPayload == nil {
+		return a
+	}
+	a.Fields = append(a.Fields, n.customPayload.Fields...)
+	return a
+}
+
+// Post sends a new attachment and returns its timestamp, to be passed to
+// Update as the message's content changes.
+func (n *notifier) Post(m message) (ts string, err error) {
+	_, ts, err = n.cl.PostMessage(n.channelID, slack.MsgOptionAttachments(n.merge(m)))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return ts, nil
+}
+
+// Update replaces the attachment at ts in place via chat.update.
+func (n *notifier) Update(ts string, m message) error {
+	_, _, _, err := n.cl.UpdateMessage(n.channelID, ts, slack.MsgOptionAttachments(n.merge(m)))
+	return errors.WithStack(err)
+}